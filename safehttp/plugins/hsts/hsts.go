@@ -33,6 +33,9 @@
 package hsts
 
 import (
+	"fmt"
+	"net"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
@@ -41,6 +44,12 @@ import (
 	"github.com/google/go-safeweb/safehttp"
 )
 
+// preloadMinMaxAge is the minimum max-age, in seconds, required by
+// https://hstspreload.org/ for a domain to be accepted onto the browser
+// HSTS preload list. The site itself recommends two years, but only
+// enforces one.
+const preloadMinMaxAge = 31536000 * time.Second
+
 // Interceptor implements automatic HSTS functionality.
 // See https://tools.ietf.org/html/rfc6797 for more info.
 type Interceptor struct {
@@ -68,10 +77,126 @@ type Interceptor struct {
 	// then the plugin will always send the Strict-Transport-Security
 	// header and will not redirect HTTP traffic to HTTPS traffic.
 	BehindProxy bool
+
+	// TrustedProxyHeaders lists request header name/value pairs that,
+	// when one of them matches on an incoming request, indicate that a
+	// trusted reverse proxy terminated HTTPS on the client's behalf
+	// before forwarding the request here in plaintext (e.g.
+	// {"X-Forwarded-Proto": "https"}). Modeled after unrolled/secure's
+	// SSLProxyHeaders. Unlike BehindProxy, this is conditional: a
+	// request without a matching header is still treated as plain HTTP.
+	//
+	// Only trust headers that the proxy sets and strips from
+	// client-supplied requests; otherwise a client can spoof HTTPS by
+	// sending the header itself. Pair this with TrustedProxyCIDRs when
+	// the server is also reachable directly, bypassing the proxy.
+	TrustedProxyHeaders map[string]string
+
+	// TrustedProxyCIDRs, when non-empty, restricts TrustedProxyHeaders
+	// to requests whose RemoteAddr falls within one of these networks.
+	// Leave empty only when the server is reachable exclusively through
+	// the trusted proxy.
+	TrustedProxyCIDRs []netip.Prefix
+
+	// RedirectHost overrides the host used when redirecting HTTP
+	// requests to HTTPS. Leave empty to redirect to the same host the
+	// request arrived on. Set this when the plaintext listener answers
+	// on a bare domain but HTTPS is served from a different host, e.g.
+	// "www.example.com" or a dedicated SSL host.
+	RedirectHost string
+
+	// RedirectStatusCode is the status code used for the HTTP to HTTPS
+	// redirect. Defaults to 301 (Moved Permanently) when zero. Use 307
+	// or 308 to preserve the request method and body across the
+	// redirect, or 302 for a staged rollout that's easy to undo.
+	RedirectStatusCode int
+
+	// AllowedHosts, when non-empty, restricts the HTTP to HTTPS redirect
+	// to requests whose Host matches one of these values. A request for
+	// any other host is rejected instead of redirected, so a forged Host
+	// header can't be used to redirect visitors to an attacker-chosen
+	// domain.
+	AllowedHosts []string
+
+	// Disabled puts the interceptor into HSTS rollback mode: Before
+	// emits "Strict-Transport-Security: max-age=0" on HTTPS responses,
+	// which tells browsers to forget any previously cached HSTS pin for
+	// this host, instead of skipping the header. It also stops
+	// redirecting HTTP requests to HTTPS. Per RFC 6797, this is the only
+	// way to recover from a bad HSTS deployment (expired cert, a
+	// preloaded subdomain that can't serve TLS, ...) without waiting for
+	// every visitor's cached max-age to expire on its own.
+	//
+	// This is distinct from the zero value of MaxAge, which means "no
+	// MaxAge configured" and is otherwise treated like any other
+	// Interceptor field left unset.
+	Disabled bool
 }
 
 var _ safehttp.Interceptor = Interceptor{}
 
+// Override customizes HSTS behavior for a single route. Install it
+// through the route's InterceptorConfig to vary HSTS per handler instead
+// of only globally.
+//
+// Overrides may only narrow the protection the Interceptor otherwise
+// provides: they can disable HSTS entirely, shorten MaxAge or drop
+// includeSubDomains, but can never lengthen MaxAge or re-enable
+// includeSubDomains once the Interceptor has disabled it. Narrowing also
+// requires LowerAllowed; without it, Disable, MaxAge and
+// DisableIncludeSubDomains are ignored, so a single misconfigured or
+// compromised route can't silently turn a global HSTS policy off.
+//
+// When the Interceptor has Preload set, Before checks the merged
+// configuration with Validate: an Override that shortens MaxAge below one
+// year or drops includeSubDomains makes Before respond with 500 Internal
+// Server Error for that route rather than emit a weaker header.
+//
+// Override cannot turn Preload on. Strict-Transport-Security preloading
+// is a whole-origin property enforced by browsers and by
+// hstspreload.org, so selectively enabling it for one route would be
+// incoherent; Preload can only be set globally on the Interceptor. A
+// route can still use Disable to drop the header, preload directive
+// included, for that route alone.
+type Override struct {
+	// LowerAllowed must be true for Disable, MaxAge or
+	// DisableIncludeSubDomains to take effect. It exists so that
+	// weakening HSTS for a route is always an explicit, reviewable
+	// opt-in rather than a side effect of setting one of those fields.
+	LowerAllowed bool
+
+	// Disable turns off HSTS entirely for this route: no header is set
+	// and no HTTP to HTTPS redirect is performed. Requires LowerAllowed.
+	Disable bool
+
+	// MaxAge, when non-nil, shortens the Interceptor's MaxAge for this
+	// route. It is ignored if it would lengthen MaxAge. Requires
+	// LowerAllowed.
+	MaxAge *time.Duration
+
+	// DisableIncludeSubDomains, when true, drops the includeSubDomains
+	// directive for this route even if the Interceptor enables it
+	// globally. Requires LowerAllowed.
+	DisableIncludeSubDomains bool
+}
+
+var _ safehttp.InterceptorConfig = Override{}
+
+// withOverride merges o on top of it, applying only the narrowing
+// described on Override, and only when LowerAllowed is set.
+func (it Interceptor) withOverride(o Override) Interceptor {
+	if !o.LowerAllowed {
+		return it
+	}
+	if o.MaxAge != nil && *o.MaxAge < it.MaxAge {
+		it.MaxAge = *o.MaxAge
+	}
+	if o.DisableIncludeSubDomains {
+		it.DisableIncludeSubDomains = true
+	}
+	return it
+}
+
 // Default creates a new HSTS interceptor with safe defaults.
 // These safe defaults are:
 //   - max-age set to 2 years,
@@ -81,26 +206,96 @@ func Default() Interceptor {
 	return Interceptor{MaxAge: 63072000 * time.Second} // two years in seconds
 }
 
+// Preloaded creates a new HSTS interceptor configured to satisfy the
+// submission requirements of https://hstspreload.org/: max-age set to
+// two years, includeSubDomains enabled and preload enabled.
+//
+// Submitting to the preload list is a one-way door: browsers will refuse
+// HTTP for this domain and all its subdomains until the list entry
+// expires, even if HSTS is later disabled. Only use this once the site
+// and all its subdomains are ready to serve HTTPS exclusively.
+func Preloaded() Interceptor {
+	it := Interceptor{
+		MaxAge:  63072000 * time.Second, // two years in seconds
+		Preload: true,
+	}
+	if err := it.Validate(); err != nil {
+		// Unreachable: the defaults above always satisfy Validate.
+		panic(err)
+	}
+	return it
+}
+
+// Validate reports whether the interceptor's configuration is consistent
+// with the https://hstspreload.org/ submission requirements. It is a
+// no-op unless Preload is set, since the requirements only apply to
+// domains requesting preload list inclusion. The "no path scoping"
+// requirement is satisfied by construction: Override cannot selectively
+// turn Preload on for a single route, so Preload can only be enabled
+// globally, never just for part of the site (a route can still opt out
+// entirely via Override.Disable).
+func (it Interceptor) Validate() error {
+	if !it.Preload {
+		return nil
+	}
+	if it.MaxAge < preloadMinMaxAge {
+		return fmt.Errorf("hsts: Preload requires MaxAge of at least %s, got %s", preloadMinMaxAge, it.MaxAge)
+	}
+	if it.DisableIncludeSubDomains {
+		return fmt.Errorf("hsts: Preload requires DisableIncludeSubDomains to be false")
+	}
+	return nil
+}
+
 // Before should be executed before the request is sent to the handler.
 // The function redirects HTTP requests to HTTPS. When HTTPS traffic
 // is received the Strict-Transport-Security header is applied to the
 // response.
-func (it Interceptor) Before(w safehttp.ResponseWriter, r *safehttp.IncomingRequest, _ safehttp.InterceptorConfig) safehttp.Result {
+func (it Interceptor) Before(w safehttp.ResponseWriter, r *safehttp.IncomingRequest, cfg safehttp.InterceptorConfig) safehttp.Result {
 	if safehttp.IsLocalDev() {
 		return safehttp.NotWritten()
 	}
 
+	if o, ok := cfg.(Override); ok {
+		if o.LowerAllowed && o.Disable {
+			return safehttp.NotWritten()
+		}
+		it = it.withOverride(o)
+	}
+
+	if it.Disabled {
+		if it.isHTTPS(r) {
+			set := w.Header().Claim("Strict-Transport-Security")
+			set([]string{"max-age=0"})
+		}
+		return safehttp.NotWritten()
+	}
+
 	if it.MaxAge < 0 {
 		return w.WriteError(safehttp.StatusInternalServerError)
 	}
 
-	if !it.BehindProxy && r.TLS == nil {
+	if err := it.Validate(); err != nil {
+		return w.WriteError(safehttp.StatusInternalServerError)
+	}
+
+	if !it.isHTTPS(r) {
 		u, err := url.Parse(r.URL().String())
 		if err != nil {
 			return w.WriteError(safehttp.StatusInternalServerError)
 		}
+		if len(it.AllowedHosts) > 0 && !it.hostAllowed(u.Host) {
+			return w.WriteError(safehttp.StatusBadRequest)
+		}
 		u.Scheme = "https"
-		return safehttp.Redirect(w, r, u.String(), safehttp.StatusMovedPermanently)
+		if it.RedirectHost != "" {
+			u.Host = it.RedirectHost
+		}
+		code := safehttp.StatusMovedPermanently
+		if it.RedirectStatusCode != 0 {
+			code = safehttp.StatusCode(it.RedirectStatusCode)
+		}
+		return safehttp.Redirect(w, r, u.String(), code)
 	}
 
 	var value strings.Builder
@@ -117,11 +312,67 @@ func (it Interceptor) Before(w safehttp.ResponseWriter, r *safehttp.IncomingRequ
 	return safehttp.NotWritten()
 }
 
+// isHTTPS reports whether r reached this server over HTTPS, either
+// directly, because the interceptor unconditionally trusts a proxy
+// (BehindProxy), or because a trusted proxy said so via
+// TrustedProxyHeaders.
+func (it Interceptor) isHTTPS(r *safehttp.IncomingRequest) bool {
+	return r.TLS != nil || it.BehindProxy || it.trustedProxySeesHTTPS(r)
+}
+
+// trustedProxySeesHTTPS reports whether a trusted proxy has told us,
+// through TrustedProxyHeaders, that it terminated HTTPS on behalf of r.
+func (it Interceptor) trustedProxySeesHTTPS(r *safehttp.IncomingRequest) bool {
+	if len(it.TrustedProxyHeaders) == 0 {
+		return false
+	}
+	if len(it.TrustedProxyCIDRs) > 0 && !it.remoteAddrIsTrustedProxy(r) {
+		return false
+	}
+	for name, want := range it.TrustedProxyHeaders {
+		if r.Header().Get(name) == want {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddrIsTrustedProxy reports whether r.RemoteAddr falls within one
+// of the configured TrustedProxyCIDRs.
+func (it Interceptor) remoteAddrIsTrustedProxy(r *safehttp.IncomingRequest) bool {
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range it.TrustedProxyCIDRs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostAllowed reports whether host is listed in AllowedHosts.
+func (it Interceptor) hostAllowed(host string) bool {
+	for _, h := range it.AllowedHosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
 // Commit is a no-op, required to satisfy the safehttp.Interceptor interface.
 func (Interceptor) Commit(w safehttp.ResponseHeadersWriter, r *safehttp.IncomingRequest, resp safehttp.Response, _ safehttp.InterceptorConfig) {
 }
 
-// Match returns false since there are no supported configurations.
-func (Interceptor) Match(safehttp.InterceptorConfig) bool {
-	return false
+// Match returns true for Override, the only supported per-route
+// configuration.
+func (Interceptor) Match(cfg safehttp.InterceptorConfig) bool {
+	_, ok := cfg.(Override)
+	return ok
 }
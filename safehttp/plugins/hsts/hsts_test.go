@@ -0,0 +1,302 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hsts
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-safeweb/safehttp"
+	"github.com/google/go-safeweb/safehttp/safehttptest"
+)
+
+// before runs it.Before against a GET request for target and reports the
+// resulting status code, the recorded Location header, and the recorded
+// Strict-Transport-Security value. The connection is treated as
+// TLS-terminated whenever target uses the https:// scheme, regardless of
+// what safehttptest infers from the URL.
+func before(t *testing.T, it Interceptor, cfg safehttp.InterceptorConfig, target string) (status safehttp.StatusCode, location, hsts string) {
+	t.Helper()
+	req := safehttptest.NewRequest(http.MethodGet, target, nil)
+	if strings.HasPrefix(target, "https://") {
+		req.TLS = &tls.ConnectionState{}
+	}
+	rr := safehttptest.NewResponseRecorder()
+	it.Before(rr.ResponseWriter, req, cfg)
+	return rr.Status(), rr.Header().Get("Location"), rr.Header().Get("Strict-Transport-Security")
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		it      Interceptor
+		wantErr bool
+	}{
+		{
+			name: "preload disabled, any MaxAge is fine",
+			it:   Interceptor{MaxAge: time.Second},
+		},
+		{
+			name: "preload enabled with safe defaults",
+			it:   Preloaded(),
+		},
+		{
+			name:    "preload requires at least a year of MaxAge",
+			it:      Interceptor{Preload: true, MaxAge: 30 * 24 * time.Hour},
+			wantErr: true,
+		},
+		{
+			name:    "preload requires includeSubDomains",
+			it:      Interceptor{Preload: true, MaxAge: 2 * 365 * 24 * time.Hour, DisableIncludeSubDomains: true},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.it.Validate()
+			if (err != nil) != test.wantErr {
+				t.Errorf("Validate() = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestBeforeRejectsInvalidPreloadConfig(t *testing.T) {
+	it := Interceptor{Preload: true, MaxAge: time.Second} // too short to preload
+	status, _, _ := before(t, it, nil, "https://foo.com/")
+	if status != safehttp.StatusInternalServerError {
+		t.Errorf("status = %v, want %v", status, safehttp.StatusInternalServerError)
+	}
+}
+
+func TestTrustedProxyHeaders(t *testing.T) {
+	tests := []struct {
+		name         string
+		headers      map[string]string
+		cidrs        []netip.Prefix
+		remoteAddr   string
+		wantRedirect bool
+	}{
+		{
+			name:         "no trusted headers configured, plain HTTP redirects",
+			wantRedirect: true,
+		},
+		{
+			name:         "matching forwarded-proto header is trusted",
+			headers:      map[string]string{"X-Forwarded-Proto": "https"},
+			wantRedirect: false,
+		},
+		{
+			name:         "non-matching header value still redirects",
+			headers:      map[string]string{"X-Forwarded-Proto": "http"},
+			wantRedirect: true,
+		},
+		{
+			name:         "matching header from an untrusted CIDR still redirects",
+			headers:      map[string]string{"X-Forwarded-Proto": "https"},
+			cidrs:        []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			remoteAddr:   "203.0.113.5:1234",
+			wantRedirect: true,
+		},
+		{
+			name:         "matching header from a trusted CIDR is honored",
+			headers:      map[string]string{"X-Forwarded-Proto": "https"},
+			cidrs:        []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			remoteAddr:   "10.1.2.3:1234",
+			wantRedirect: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			it := Interceptor{MaxAge: 2 * 365 * 24 * time.Hour, TrustedProxyHeaders: test.headers, TrustedProxyCIDRs: test.cidrs}
+			req := safehttptest.NewRequest(http.MethodGet, "http://foo.com/", nil)
+			req.RemoteAddr = test.remoteAddr
+			for name, value := range test.headers {
+				req.Header().Set(name, value)
+			}
+			rr := safehttptest.NewResponseRecorder()
+			it.Before(rr.ResponseWriter, req, nil)
+
+			gotRedirect := rr.Status() == safehttp.StatusMovedPermanently
+			if gotRedirect != test.wantRedirect {
+				t.Errorf("redirected = %v, want %v (status %v)", gotRedirect, test.wantRedirect, rr.Status())
+			}
+			if !test.wantRedirect && rr.Header().Get("Strict-Transport-Security") == "" {
+				t.Errorf("Strict-Transport-Security header missing on trusted HTTPS request")
+			}
+		})
+	}
+}
+
+func TestOverrideLowerAllowedGate(t *testing.T) {
+	base := Interceptor{MaxAge: 2 * 365 * 24 * time.Hour} // 63072000s
+	shortAge := 24 * time.Hour
+	longAge := 3 * 365 * 24 * time.Hour
+
+	tests := []struct {
+		name       string
+		override   Override
+		target     string
+		wantHeader string
+	}{
+		{
+			name:       "Disable without LowerAllowed is ignored",
+			override:   Override{Disable: true},
+			target:     "https://foo.com/",
+			wantHeader: "max-age=63072000; includeSubDomains",
+		},
+		{
+			name:       "Disable with LowerAllowed turns off HSTS",
+			override:   Override{Disable: true, LowerAllowed: true},
+			target:     "https://foo.com/",
+			wantHeader: "",
+		},
+		{
+			name:       "MaxAge shortening without LowerAllowed is ignored",
+			override:   Override{MaxAge: &shortAge},
+			target:     "https://foo.com/",
+			wantHeader: "max-age=63072000; includeSubDomains",
+		},
+		{
+			name:       "MaxAge shortening applies with LowerAllowed",
+			override:   Override{MaxAge: &shortAge, LowerAllowed: true},
+			target:     "https://foo.com/",
+			wantHeader: "max-age=86400; includeSubDomains",
+		},
+		{
+			name:       "MaxAge lengthening is ignored even with LowerAllowed",
+			override:   Override{MaxAge: &longAge, LowerAllowed: true},
+			target:     "https://foo.com/",
+			wantHeader: "max-age=63072000; includeSubDomains",
+		},
+		{
+			name:       "DisableIncludeSubDomains without LowerAllowed is ignored",
+			override:   Override{DisableIncludeSubDomains: true},
+			target:     "https://foo.com/",
+			wantHeader: "max-age=63072000; includeSubDomains",
+		},
+		{
+			name:       "DisableIncludeSubDomains applies with LowerAllowed",
+			override:   Override{DisableIncludeSubDomains: true, LowerAllowed: true},
+			target:     "https://foo.com/",
+			wantHeader: "max-age=63072000",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, got := before(t, base, test.override, test.target)
+			if got != test.wantHeader {
+				t.Errorf("header = %q, want %q", got, test.wantHeader)
+			}
+		})
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	tests := []struct {
+		name         string
+		allowedHosts []string
+		target       string
+		wantStatus   safehttp.StatusCode
+	}{
+		{
+			name:       "no AllowedHosts configured, any host redirects",
+			target:     "http://evil.com/",
+			wantStatus: safehttp.StatusMovedPermanently,
+		},
+		{
+			name:         "host in AllowedHosts redirects",
+			allowedHosts: []string{"foo.com"},
+			target:       "http://foo.com/",
+			wantStatus:   safehttp.StatusMovedPermanently,
+		},
+		{
+			name:         "host not in AllowedHosts is rejected",
+			allowedHosts: []string{"foo.com"},
+			target:       "http://evil.com/",
+			wantStatus:   safehttp.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			it := Interceptor{MaxAge: 2 * 365 * 24 * time.Hour, AllowedHosts: test.allowedHosts}
+			status, _, _ := before(t, it, nil, test.target)
+			if status != test.wantStatus {
+				t.Errorf("status = %v, want %v", status, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRedirectHostAndStatusCode(t *testing.T) {
+	it := Interceptor{
+		MaxAge:             2 * 365 * 24 * time.Hour,
+		RedirectHost:       "www.foo.com",
+		RedirectStatusCode: int(safehttp.StatusTemporaryRedirect),
+	}
+	status, location, _ := before(t, it, nil, "http://foo.com/")
+	if status != safehttp.StatusTemporaryRedirect {
+		t.Errorf("status = %v, want %v", status, safehttp.StatusTemporaryRedirect)
+	}
+	if want := "https://www.foo.com/"; location != want {
+		t.Errorf("Location = %q, want %q", location, want)
+	}
+}
+
+func TestRedirectStatusCodeDefaultsTo301(t *testing.T) {
+	it := Interceptor{MaxAge: 2 * 365 * 24 * time.Hour}
+	status, _, _ := before(t, it, nil, "http://foo.com/")
+	if status != safehttp.StatusMovedPermanently {
+		t.Errorf("status = %v, want %v", status, safehttp.StatusMovedPermanently)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	it := Interceptor{MaxAge: 2 * 365 * 24 * time.Hour, Disabled: true}
+
+	t.Run("HTTPS response gets max-age=0", func(t *testing.T) {
+		status, _, hsts := before(t, it, nil, "https://foo.com/")
+		if hsts != "max-age=0" {
+			t.Errorf("Strict-Transport-Security = %q, want %q", hsts, "max-age=0")
+		}
+		if status == safehttp.StatusMovedPermanently {
+			t.Errorf("status = %v, redirect should not happen while Disabled", status)
+		}
+	})
+
+	t.Run("HTTP request is not redirected", func(t *testing.T) {
+		status, _, hsts := before(t, it, nil, "http://foo.com/")
+		if status == safehttp.StatusMovedPermanently {
+			t.Errorf("status = %v, redirect should not happen while Disabled", status)
+		}
+		if hsts != "" {
+			t.Errorf("Strict-Transport-Security = %q, want empty on plain HTTP", hsts)
+		}
+	})
+}
+
+func TestMatch(t *testing.T) {
+	var it Interceptor
+	if it.Match(Override{}) != true {
+		t.Error("Match(Override{}) = false, want true")
+	}
+	if it.Match(nil) != false {
+		t.Error("Match(nil) = true, want false")
+	}
+}